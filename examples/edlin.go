@@ -4,6 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"zappem.net/pub/io/lined"
 )
@@ -12,10 +14,59 @@ var (
 	prompt = flag.String("prompt", "prompt> ", "input prompt")
 )
 
+// commands lists the words this shell recognizes, and doubles as the
+// vocabulary offered by completer.
+var commands = []string{"exit", "password"}
+
+// completer completes the word to the left of pos in line against
+// commands.
+func completer(line string, pos int) (head string, completions []string, tail string) {
+	word := line[:pos]
+	start := strings.LastIndexAny(word, " \t") + 1
+	head, frag := line[:start], word[start:]
+	tail = line[pos:]
+	for _, cmd := range commands {
+		if strings.HasPrefix(cmd, frag) {
+			completions = append(completions, cmd)
+		}
+	}
+	return head, completions, tail
+}
+
+// historyPath returns the path of the persisted history file, or ""
+// if the user's home directory cannot be determined.
+func historyPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".myshell_history")
+}
+
 func main() {
 	flag.Parse()
 
 	r := lined.NewReader()
+	r.SetCompleter(completer)
+	r.SetMaxHistory(1000)
+
+	hist := historyPath()
+	if hist != "" {
+		if f, err := os.Open(hist); err == nil {
+			r.LoadHistory(f)
+			f.Close()
+		}
+	}
+	saveHistory := func() {
+		if hist == "" {
+			return
+		}
+		if f, err := os.Create(hist); err == nil {
+			r.SaveHistory(f)
+			f.Close()
+		}
+	}
+
 	pass := false
 	thisPrompt := *prompt
 	for {
@@ -35,11 +86,18 @@ func main() {
 			fmt.Println()
 			if err == lined.ErrEOF {
 				if len(line) != 0 {
-					fmt.Println("no auto-fill suggestions")
+					_, completions, _ := completer(line, len(line))
+					if len(completions) == 0 {
+						fmt.Println("no auto-fill suggestions")
+					} else {
+						fmt.Println(strings.Join(completions, "  "))
+					}
 					continue
 				}
+				saveHistory()
 				os.Exit(0)
 			} else {
+				saveHistory()
 				fmt.Printf("failed to read line: %v", err)
 				os.Exit(1)
 			}
@@ -48,6 +106,7 @@ func main() {
 		switch line[:len(line)-1] {
 		case "exit":
 			fmt.Println("exiting")
+			saveHistory()
 			os.Exit(0)
 		case "password":
 			pass = true
@@ -7,47 +7,263 @@
 package lined
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"golang.org/x/term"
+	"golang.org/x/text/width"
 )
 
+// Completer is the signature of a function that proposes completions
+// for the word at pos in line. head is the unchanged portion of line
+// before the word being completed, tail is the unchanged portion
+// after it, and completions lists the candidate replacements for the
+// word. This mirrors the liner/x/term AutoCompleteCallback shape.
+type Completer func(line string, pos int) (head string, completions []string, tail string)
+
+// TerminalSizer reports the current size of the terminal attached to a
+// Reader. Readers created with NewReader determine this via the
+// os.Stdin ioctl instead; a TerminalSizer is how a Reader created with
+// NewReaderIO learns it, since in/out need not be backed by a real tty
+// (for example, an ssh.Server session channel, which instead reports
+// size changes through "pty-req"/"window-change" requests).
+type TerminalSizer interface {
+	GetSize() (cols, rows int, err error)
+}
+
 // Reader implements a line string reader.
 type Reader struct {
-	mu       sync.Mutex
-	h        []string
-	unread   []byte
-	offset   int
-	row, col int // size of screen (refreshed each time readString is called.
-	atR, atC int // last displayed cursor position.
+	mu             sync.Mutex
+	h              []string
+	maxHistory     int
+	historyFilter  func(string) bool
+	unread         []byte
+	offset         int
+	row, col       int // size of screen (refreshed each time readString is called.
+	atR, atC       int // last displayed cursor position.
+	completer      Completer
+	kills          []string // bounded kill ring, oldest first.
+	in             io.Reader
+	out            io.Writer
+	sizer          TerminalSizer
+	pasting        bool // inside a bracketed-paste (\033[200~ ... \033[201~) block.
+	multilinePaste bool
+	pastePending   []byte // unscanned paste bytes carried over a line return, re-fed through the paste scanner.
+}
+
+// maxKillRing bounds the number of entries retained in (*Reader).kills.
+const maxKillRing = 16
+
+// addKill records text as a kill-ring entry. If merge is true, text
+// is folded into the most recent entry instead of pushed as a new
+// one, matching readline's behavior for consecutive kill commands;
+// forward controls whether it is appended or prepended.
+func (r *Reader) addKill(text string, merge, forward bool) {
+	if text == "" {
+		return
+	}
+	if merge && len(r.kills) > 0 {
+		i := len(r.kills) - 1
+		if forward {
+			r.kills[i] += text
+		} else {
+			r.kills[i] = text + r.kills[i]
+		}
+		return
+	}
+	r.kills = append(r.kills, text)
+	if len(r.kills) > maxKillRing {
+		r.kills = r.kills[len(r.kills)-maxKillRing:]
+	}
+}
+
+// isWordRune reports whether u is part of a readline "word": runs of
+// alphanumerics are words, everything else is a boundary.
+func isWordRune(u rune) bool {
+	return unicode.IsLetter(u) || unicode.IsDigit(u)
+}
+
+// wordBack returns the rune index of the start of the word to the
+// left of pos in s, skipping any boundary runes first.
+func wordBack(s []byte, pos int) int {
+	rs := bytes.Runes(s)
+	for pos > 0 && !isWordRune(rs[pos-1]) {
+		pos--
+	}
+	for pos > 0 && isWordRune(rs[pos-1]) {
+		pos--
+	}
+	return pos
+}
+
+// wordForward returns the rune index of the end of the word to the
+// right of pos in s, skipping any boundary runes first.
+func wordForward(s []byte, pos int) int {
+	rs := bytes.Runes(s)
+	n := len(rs)
+	for pos < n && !isWordRune(rs[pos]) {
+		pos++
+	}
+	for pos < n && isWordRune(rs[pos]) {
+		pos++
+	}
+	return pos
+}
+
+// runeWidth returns the number of terminal columns u occupies: 0 for
+// combining marks, 2 for East Asian wide/fullwidth runes, 1
+// otherwise.
+func runeWidth(u rune) int {
+	if unicode.Is(unicode.Mn, u) || unicode.Is(unicode.Me, u) {
+		return 0
+	}
+	switch width.LookupRune(u).Kind() {
+	case width.EastAsianWide, width.EastAsianFullwidth:
+		return 2
+	}
+	return 1
+}
+
+// displayWidth returns the total terminal column width of s.
+func displayWidth(s string) int {
+	w := 0
+	for _, u := range s {
+		w += runeWidth(u)
+	}
+	return w
 }
 
 // NewReader returns a new Reader that sources its data from
 // os.Stdin allowing editing visible via os.Stdout.
 func NewReader() *Reader {
-	return &Reader{}
+	return &Reader{in: os.Stdin, out: os.Stdout}
 }
 
-// reset resets the terminal settings to their original state.
-func reset(orig *term.State) {
-	if orig == nil {
+// NewReaderIO returns a new Reader that reads from in and writes
+// editing output to out, instead of the default os.Stdin/os.Stdout.
+// This is what makes lined usable over a connection that isn't a
+// local tty, such as an ssh.Server session channel. sizer, if
+// non-nil, is consulted for the terminal size whenever in is not a
+// tty *os.File (a tty input is sized by its own ioctl, as with
+// NewReader); pass nil and call SetSize directly if the size is
+// already known and fixed.
+func NewReaderIO(in io.Reader, out io.Writer, sizer TerminalSizer) *Reader {
+	return &Reader{in: in, out: out, sizer: sizer}
+}
+
+// SetSize sets the terminal size Reader assumes for line-wrapping
+// and redraw geometry. Each ReadString or ReadPassword call first
+// re-reads the size from the tty ioctl, when the input is a tty, or
+// else from the TerminalSizer, if one is configured, replacing what
+// SetSize set. For a Reader with neither, call this up front and
+// again after each window-change notification.
+func (r *Reader) SetSize(cols, rows int) {
+	if r == nil {
 		return
 	}
-	sc, err := os.Stdin.SyscallConn()
-	if err == nil {
-		sc.Control(func(fd uintptr) {
-			fdi := int(fd)
-			// Reenable input echo.
-			term.Restore(fdi, orig)
-		})
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.col, r.row = cols, rows
+}
+
+// AllowMultilinePaste controls how a bracketed paste containing
+// embedded newlines is handled. With allow set to false (the
+// default), each embedded newline ends the current line as if Enter
+// had been pressed, so ReadString returns once per pasted line. With
+// allow set to true, embedded newlines are inserted into the buffer
+// literally, and ReadString returns the whole pasted block, newlines
+// included, as a single line once the user presses Enter for real.
+func (r *Reader) AllowMultilinePaste(allow bool) {
+	if r == nil {
+		return
 	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.multilinePaste = allow
+}
+
+// SetCompleter registers c as the function used to look up Tab
+// completions. A nil c disables completion.
+func (r *Reader) SetCompleter(c Completer) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.completer = c
+}
+
+// commonPrefix returns the longest string that is a prefix of every
+// entry in ss. It returns "" for an empty ss.
+func commonPrefix(ss []string) string {
+	if len(ss) == 0 {
+		return ""
+	}
+	prefix := ss[0]
+	for _, s := range ss[1:] {
+		i := 0
+		for i < len(prefix) && i < len(s) && prefix[i] == s[i] {
+			i++
+		}
+		prefix = prefix[:i]
+		if prefix == "" {
+			break
+		}
+	}
+	return prefix
+}
+
+// listCandidates prints completions below the current line, arranged
+// in columns sized to fit r.col. The caller is responsible for
+// arranging for the in-progress line to be redrawn afterward.
+func (r *Reader) listCandidates(completions []string) {
+	colWidth := 0
+	for _, c := range completions {
+		if l := displayWidth(c); l > colWidth {
+			colWidth = l
+		}
+	}
+	colWidth += 2
+	cols := r.col / colWidth
+	if cols < 1 {
+		cols = 1
+	}
+	fmt.Fprint(r.out, "\\\r\n")
+	for i, c := range completions {
+		fmt.Fprintf(r.out, "%-*s", colWidth, c)
+		if (i+1)%cols == 0 {
+			fmt.Fprint(r.out, "\\\r\n")
+		}
+	}
+	if len(completions)%cols != 0 {
+		fmt.Fprint(r.out, "\\\r\n")
+	}
+}
+
+// reset resets the terminal settings to their original state. fdi is
+// ignored when orig is nil, which is always the case for a Reader
+// whose input isn't a real tty os.File (so there was nothing to put
+// into raw mode in the first place).
+func reset(fdi int, orig *term.State) {
+	if orig == nil {
+		return
+	}
+	term.Restore(fdi, orig)
 }
 
 // match matches one of a number of strings to the start of an array
@@ -81,12 +297,118 @@ func (r *Reader) History(n int) (string, int) {
 	return r.h[m-1-n], m
 }
 
+// SetMaxHistory limits the number of lines retained in history to n.
+// A value of 0 (the default) means no limit. If history already
+// holds more than n lines, the oldest are dropped immediately.
+func (r *Reader) SetMaxHistory(n int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maxHistory = n
+	r.trimHistory()
+}
+
+// SetHistoryFilter registers f to decide whether a line is eligible
+// to be recorded in history: lines for which f returns false are
+// dropped rather than stored. A nil f, the default, records every
+// line. This can be used, for example, to suppress lines that begin
+// with a space.
+func (r *Reader) SetHistoryFilter(f func(string) bool) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.historyFilter = f
+}
+
+// trimHistory drops the oldest entries until len(r.h) <= r.maxHistory.
+// r.mu must be held by the caller.
+func (r *Reader) trimHistory() {
+	if r.maxHistory > 0 && len(r.h) > r.maxHistory {
+		r.h = r.h[len(r.h)-r.maxHistory:]
+	}
+}
+
+// addHistory appends the newline-terminated line to history, subject
+// to the configured filter, suppression of consecutive duplicates,
+// and the SetMaxHistory limit. r.mu must be held by the caller.
+func (r *Reader) addHistory(line string) {
+	if r.historyFilter != nil && !r.historyFilter(line) {
+		return
+	}
+	if n := len(r.h); n > 0 && r.h[n-1] == line {
+		return
+	}
+	r.h = append(r.h, line)
+	r.trimHistory()
+}
+
+// AppendHistory adds line to the in-memory history as if it had just
+// been entered interactively, subject to the same filter and
+// consecutive-duplicate suppression as ReadString.
+func (r *Reader) AppendHistory(line string) {
+	if r == nil {
+		return
+	}
+	if !strings.HasSuffix(line, "\n") {
+		line += "\n"
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addHistory(line)
+}
+
+// LoadHistory reads newline-terminated history lines from in,
+// skipping blank lines, and merges them into the in-memory history in
+// the order read, applying the same filter and consecutive-duplicate
+// suppression as ReadString. It returns how many entries the history
+// grew by, which is less than the number of lines accepted once the
+// SetMaxHistory limit drops older entries.
+func (r *Reader) LoadHistory(in io.Reader) (n int, err error) {
+	if r == nil {
+		return 0, ErrNoReader
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	scanner := bufio.NewScanner(in)
+	before := len(r.h)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		r.addHistory(line + "\n")
+	}
+	return len(r.h) - before, scanner.Err()
+}
+
+// SaveHistory writes the in-memory history to out, one newline
+// terminated entry per line, in the plain text form accepted by
+// LoadHistory.
+func (r *Reader) SaveHistory(out io.Writer) error {
+	if r == nil {
+		return ErrNoReader
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w := bufio.NewWriter(out)
+	for _, line := range r.h {
+		if _, err := w.WriteString(line); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
 // moves the cursor n columns up.
 func (r *Reader) up(n int) {
 	if n > 0 {
-		fmt.Printf("\033[%dA", n)
+		fmt.Fprintf(r.out, "\033[%dA", n)
 	} else if n < 0 {
-		fmt.Printf("\033[%dB", -n)
+		fmt.Fprintf(r.out, "\033[%dB", -n)
 	}
 }
 
@@ -103,25 +425,25 @@ func (r *Reader) right(n int) {
 // moves the cursor n columns left.
 func (r *Reader) left(n int) {
 	if n > 0 {
-		fmt.Printf("\033[%dD", n)
+		fmt.Fprintf(r.out, "\033[%dD", n)
 	} else if n < 0 {
-		fmt.Printf("\033[%dC", -n)
+		fmt.Fprintf(r.out, "\033[%dC", -n)
 	}
 }
 
 // start moves the cursor to the start of the line.
 func (r *Reader) start() {
-	fmt.Print("\033[G")
+	fmt.Fprint(r.out, "\033[G")
 }
 
 // clearEOL clears from (and including) the cursor location to the end of the line.
 func (r *Reader) clearEOL() {
-	fmt.Print("\033[0K")
+	fmt.Fprint(r.out, "\033[0K")
 }
 
 // clearLine clears all of the line the cursor is on
 func (r *Reader) clearLine() {
-	fmt.Print("\033[2K")
+	fmt.Fprint(r.out, "\033[2K")
 }
 
 // ErrNoReader is the error return for a *Reader being nil.
@@ -135,7 +457,112 @@ var (
 // first read.
 var cursorAt = regexp.MustCompile(`^(\d+);(\d+)R`)
 
+// installMu guards installedSig and savedState below.
+var installMu sync.Mutex
+var installedSig chan os.Signal
+var savedState *term.State
+
+// Install snapshots the terminal state of os.Stdin, if it is a tty,
+// and arranges for SIGINT, SIGTERM and SIGQUIT to restore it before
+// they take down the process. Without this, a program killed while a
+// Reader has stdin in raw mode leaves the user's terminal unusable
+// until they run "reset" or "stty sane" by hand. Call Restore to stop
+// watching for those signals. Calling Install again before a matching
+// Restore is a no-op.
+func Install() {
+	installMu.Lock()
+	defer installMu.Unlock()
+	if installedSig != nil {
+		return
+	}
+	fdi := int(os.Stdin.Fd())
+	if !term.IsTerminal(fdi) {
+		return
+	}
+	state, err := term.GetState(fdi)
+	if err != nil {
+		return
+	}
+	savedState = state
+	installedSig = make(chan os.Signal, 1)
+	signal.Notify(installedSig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	go func() {
+		sig, ok := <-installedSig
+		if !ok {
+			return
+		}
+		term.Restore(fdi, savedState)
+		// Re-raise the signal with its default disposition so the
+		// process still terminates the way the caller expects.
+		signal.Reset(sig)
+		if p, err := os.FindProcess(os.Getpid()); err == nil {
+			p.Signal(sig)
+		}
+	}()
+}
+
+// Restore undoes Install: it stops watching for termination signals
+// and immediately restores os.Stdin's terminal state.
+func Restore() {
+	installMu.Lock()
+	defer installMu.Unlock()
+	if installedSig == nil {
+		return
+	}
+	signal.Stop(installedSig)
+	close(installedSig)
+	if savedState != nil {
+		term.Restore(int(os.Stdin.Fd()), savedState)
+	}
+	installedSig = nil
+	savedState = nil
+}
+
+// errReadCanceled is returned by readString when the cancel channel
+// passed to it fires before a line is complete; ReadStringContext
+// translates it into its context's Err().
+var errReadCanceled = errors.New("read canceled")
+
+// readWithCancel performs in.Read(buf), returning errReadCanceled
+// immediately if cancel fires first, instead of waiting for in.Read to
+// return. A plain io.Reader offers no portable way to interrupt a
+// Read that's already blocked, so a canceled read's goroutine is not
+// waited for: it is left to finish in the background, and its result,
+// if any, is discarded. A nil cancel behaves exactly like in.Read.
+func readWithCancel(in io.Reader, buf []byte, cancel <-chan struct{}) (int, error) {
+	if cancel == nil {
+		return in.Read(buf)
+	}
+	select {
+	case <-cancel:
+		return 0, errReadCanceled
+	default:
+	}
+	type result struct {
+		n   int
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		n, err := in.Read(buf)
+		ch <- result{n, err}
+	}()
+	select {
+	case res := <-ch:
+		return res.n, res.err
+	case <-cancel:
+		return 0, errReadCanceled
+	}
+}
+
 func (r *Reader) readString(echo bool) (string, error) {
+	return r.readStringCancel(echo, nil)
+}
+
+// readStringCancel is readString's implementation, plus a cancel
+// channel that, if non-nil and closed or sent to, unblocks a pending
+// read and returns errReadCanceled instead of waiting for a line.
+func (r *Reader) readStringCancel(echo bool, cancel <-chan struct{}) (string, error) {
 	if r == nil {
 		return "", ErrNoReader
 	}
@@ -144,25 +571,131 @@ func (r *Reader) readString(echo bool) (string, error) {
 
 	var pick int
 	var orig *term.State
-	sc, err := os.Stdin.SyscallConn()
-	if err == nil {
-		sc.Control(func(fd uintptr) {
-			if fdi := int(fd); term.IsTerminal(fdi) {
-				if echo {
-					fmt.Print("\033[6n")
-				}
-				r.col, r.row, _ = term.GetSize(fdi)
-				// Disable input echo.
-				orig, _ = term.MakeRaw(fdi)
-			}
-		})
+	fdi := -1
+	isTTY := false
+	if f, ok := r.in.(*os.File); ok {
+		if sc, err := f.SyscallConn(); err == nil {
+			sc.Control(func(fd uintptr) {
+				fdi = int(fd)
+				isTTY = term.IsTerminal(fdi)
+			})
+		}
+	}
+	switch {
+	case isTTY:
+		r.col, r.row, _ = term.GetSize(fdi)
+		// Disable input echo.
+		orig, _ = term.MakeRaw(fdi)
+		fmt.Fprint(r.out, "\033[?2004h") // enable bracketed paste.
+		defer fmt.Fprint(r.out, "\033[?2004l")
+	case r.sizer != nil:
+		r.col, r.row, _ = r.sizer.GetSize()
 	}
-	defer reset(orig)
+	if isTTY && echo {
+		// Query the cursor position: unavailable/unreliable for a
+		// non-tty in (an ssh channel, a pty test harness), which
+		// should use SetSize and accept the column-1 default below.
+		fmt.Fprint(r.out, "\033[6n")
+	} else if r.atC == 0 {
+		r.atC = 1
+	}
+	defer reset(fdi, orig)
 
 	p := make([]byte, 20)
 	from := 0
 	newline := bytes.IndexByte(r.unread, byte('\n'))
 
+	// wasRow and wasCol hold the cursor's row/column position (in
+	// display columns, not runes) at the end of the previous redraw,
+	// relative to the start of the line. firstDraw marks that no
+	// redraw has happened yet, so the first one seeds its position
+	// from the reported cursor location rather than from wasRow/wasCol.
+	wasRow, wasCol := 0, 0
+	firstDraw := true
+	// wasLines holds the last iteration number of lines
+	wasLines := 0
+	// tabs counts consecutive Tab presses, for the two-stage
+	// completion behavior (complete common prefix, then list).
+	tabs := 0
+
+	// lastWasKill tracks whether the previous command was a kill
+	// (delete-word/kill-line), so consecutive kills merge into one
+	// kill-ring entry per readline convention.
+	lastWasKill := false
+	// justYanked, yankStart and yankEnd track the span of the most
+	// recent yank, so Alt-Y can cycle it through the kill ring.
+	justYanked := false
+	yankStart, yankEnd := 0, 0
+	yankRingIdx := 0
+
+	// searching, pattern and searchIdx track a reverse/forward
+	// incremental history search (Ctrl-R / Ctrl-S). While searching,
+	// r.unread displays the search prompt rather than the line being
+	// edited; saved/savedOffset hold the real buffer to restore on
+	// cancel.
+	searching := false
+	var pattern []byte
+	var saved []byte
+	savedOffset := 0
+	searchIdx := -1
+
+	// startSearch begins a new incremental search, stashing the
+	// current buffer so it can be restored on cancel.
+	startSearch := func() {
+		searching = true
+		saved = append([]byte(nil), r.unread...)
+		savedOffset = r.offset
+		pattern = nil
+		searchIdx = -1
+	}
+	// searchNewest scans r.h from newest to oldest for the most
+	// recent entry containing pattern.
+	searchNewest := func() {
+		searchIdx = -1
+		for i := len(r.h) - 1; i >= 0; i-- {
+			if bytes.Contains([]byte(r.h[i]), pattern) {
+				searchIdx = i
+				break
+			}
+		}
+	}
+	// searchStep continues the search for pattern one entry further
+	// in direction dir (-1 older, +1 newer) from the current match.
+	searchStep := func(dir int) {
+		for i := searchIdx + dir; i >= 0 && i < len(r.h); i += dir {
+			if bytes.Contains([]byte(r.h[i]), pattern) {
+				searchIdx = i
+				return
+			}
+		}
+	}
+	// renderSearch replaces the displayed line with the bash-style
+	// "(reverse-i-search)'PATTERN': MATCH" prompt, driven through the
+	// same r.unread/r.offset the normal redraw uses.
+	renderSearch := func() {
+		match := ""
+		if searchIdx >= 0 {
+			m := r.h[searchIdx]
+			match = m[:len(m)-1]
+		}
+		r.unread = []byte(fmt.Sprintf("(reverse-i-search)'%s': %s", pattern, match))
+		r.offset = utf8.RuneCount(r.unread)
+	}
+	// endSearch leaves search mode, either loading the matched line
+	// as the current buffer (accept) or restoring the pre-search
+	// buffer (cancel).
+	endSearch := func(accept bool) {
+		searching = false
+		if accept && searchIdx >= 0 {
+			m := r.h[searchIdx]
+			r.unread = []byte(m[:len(m)-1])
+			r.offset = utf8.RuneCount(r.unread)
+			return
+		}
+		r.unread = saved
+		r.offset = savedOffset
+	}
+
 	specials := []struct {
 		codes []string
 		fn    func(s string) ([]byte, error)
@@ -170,20 +703,34 @@ func (r *Reader) readString(echo bool) (string, error) {
 		{ // Delete next.
 			codes: []string{"\004", "\033[3~"},
 			fn: func(s string) ([]byte, error) {
-				if r.offset == len(r.unread) {
+				if searching {
+					return nil, nil
+				}
+				rs := bytes.Runes(r.unread)
+				if r.offset == len(rs) {
 					return r.unread, ErrEOF
-				} else {
-					r.unread = append(r.unread[:r.offset], r.unread[r.offset+1:]...)
 				}
+				rs = append(rs[:r.offset], rs[r.offset+1:]...)
+				r.unread = []byte(string(rs))
 				return nil, nil
 			},
 		},
-		{ // Delete previous
+		{ // Delete previous, or shrink the search pattern.
 			codes: []string{"\177", "\010"},
 			fn: func(s string) ([]byte, error) {
+				if searching {
+					if len(pattern) > 0 {
+						pattern = pattern[:len(pattern)-1]
+						searchNewest()
+					}
+					renderSearch()
+					return nil, nil
+				}
 				if r.offset > 0 {
+					rs := bytes.Runes(r.unread)
 					r.offset--
-					r.unread = append(r.unread[:r.offset], r.unread[r.offset+1:]...)
+					rs = append(rs[:r.offset], rs[r.offset+1:]...)
+					r.unread = []byte(string(rs))
 				}
 				return nil, nil
 			},
@@ -191,6 +738,9 @@ func (r *Reader) readString(echo bool) (string, error) {
 		{ // Start of line
 			codes: []string{"\001", "\033[H"},
 			fn: func(s string) ([]byte, error) {
+				if searching {
+					return nil, nil
+				}
 				r.offset = 0
 				return nil, nil
 			},
@@ -198,20 +748,171 @@ func (r *Reader) readString(echo bool) (string, error) {
 		{ // End of line
 			codes: []string{"\005", "\033[4~", "\033[F", "\033$"},
 			fn: func(s string) ([]byte, error) {
-				r.offset = len(r.unread)
+				if searching {
+					return nil, nil
+				}
+				r.offset = utf8.RuneCount(r.unread)
+				return nil, nil
+			},
+		},
+		{ // Alt-B: move back one word.
+			codes: []string{"\033b"},
+			fn: func(s string) ([]byte, error) {
+				if searching {
+					return nil, nil
+				}
+				r.offset = wordBack(r.unread, r.offset)
+				return nil, nil
+			},
+		},
+		{ // Alt-F: move forward one word.
+			codes: []string{"\033f"},
+			fn: func(s string) ([]byte, error) {
+				if searching {
+					return nil, nil
+				}
+				r.offset = wordForward(r.unread, r.offset)
+				return nil, nil
+			},
+		},
+		{ // Alt-D: delete word forward, into the kill ring.
+			codes: []string{"\033d"},
+			fn: func(s string) ([]byte, error) {
+				if searching {
+					return nil, nil
+				}
+				end := wordForward(r.unread, r.offset)
+				rs := bytes.Runes(r.unread)
+				r.addKill(string(rs[r.offset:end]), lastWasKill, true)
+				rs = append(rs[:r.offset], rs[end:]...)
+				r.unread = []byte(string(rs))
+				lastWasKill = true
+				return nil, nil
+			},
+		},
+		{ // Ctrl-W: delete word backward, into the kill ring.
+			codes: []string{"\027"},
+			fn: func(s string) ([]byte, error) {
+				if searching {
+					return nil, nil
+				}
+				start := wordBack(r.unread, r.offset)
+				rs := bytes.Runes(r.unread)
+				r.addKill(string(rs[start:r.offset]), lastWasKill, false)
+				rs = append(rs[:start], rs[r.offset:]...)
+				r.unread = []byte(string(rs))
+				r.offset = start
+				lastWasKill = true
+				return nil, nil
+			},
+		},
+		{ // Ctrl-U: kill to start of line.
+			codes: []string{"\025"},
+			fn: func(s string) ([]byte, error) {
+				if searching {
+					return nil, nil
+				}
+				rs := bytes.Runes(r.unread)
+				r.addKill(string(rs[:r.offset]), lastWasKill, false)
+				r.unread = []byte(string(rs[r.offset:]))
+				r.offset = 0
+				lastWasKill = true
+				return nil, nil
+			},
+		},
+		{ // Ctrl-K: kill to end of line.
+			codes: []string{"\013"},
+			fn: func(s string) ([]byte, error) {
+				if searching {
+					return nil, nil
+				}
+				rs := bytes.Runes(r.unread)
+				r.addKill(string(rs[r.offset:]), lastWasKill, true)
+				r.unread = []byte(string(rs[:r.offset]))
+				lastWasKill = true
+				return nil, nil
+			},
+		},
+		{ // Ctrl-Y: yank the most recent kill.
+			codes: []string{"\031"},
+			fn: func(s string) ([]byte, error) {
+				if searching || len(r.kills) == 0 {
+					return nil, nil
+				}
+				text := []rune(r.kills[len(r.kills)-1])
+				rs := bytes.Runes(r.unread)
+				d := append([]rune{}, rs[:r.offset]...)
+				d = append(d, text...)
+				d = append(d, rs[r.offset:]...)
+				yankStart = r.offset
+				r.unread = []byte(string(d))
+				r.offset = yankStart + len(text)
+				yankEnd = r.offset
+				yankRingIdx = len(r.kills) - 1
+				justYanked = true
+				return nil, nil
+			},
+		},
+		{ // Alt-Y: cycle the last yank through the kill ring.
+			codes: []string{"\033y"},
+			fn: func(s string) ([]byte, error) {
+				if searching || !justYanked || len(r.kills) == 0 {
+					return nil, nil
+				}
+				yankRingIdx--
+				if yankRingIdx < 0 {
+					yankRingIdx = len(r.kills) - 1
+				}
+				text := []rune(r.kills[yankRingIdx])
+				rs := bytes.Runes(r.unread)
+				d := append([]rune{}, rs[:yankStart]...)
+				d = append(d, text...)
+				d = append(d, rs[yankEnd:]...)
+				r.unread = []byte(string(d))
+				r.offset = yankStart + len(text)
+				yankEnd = r.offset
+				justYanked = true
+				return nil, nil
+			},
+		},
+		{ // Reverse incremental history search.
+			codes: []string{"\022"},
+			fn: func(s string) ([]byte, error) {
+				if !searching {
+					startSearch()
+					searchNewest()
+				} else {
+					searchStep(-1)
+				}
+				renderSearch()
+				return nil, nil
+			},
+		},
+		{ // Forward incremental history search.
+			codes: []string{"\023"},
+			fn: func(s string) ([]byte, error) {
+				if searching {
+					searchStep(1)
+					renderSearch()
+				}
 				return nil, nil
 			},
 		},
 		{ // Transpose characters
 			codes: []string{"\024"},
 			fn: func(s string) ([]byte, error) {
+				if searching {
+					return nil, nil
+				}
+				rs := bytes.Runes(r.unread)
 				c := r.offset
-				if c == len(r.unread) {
+				if c == len(rs) {
 					c--
 				}
 				if c > 0 {
 					d := c - 1
-					r.unread[c], r.unread[d] = r.unread[d], r.unread[c]
+					rs[c], rs[d] = rs[d], rs[c]
+					r.unread = []byte(string(rs))
 					if c == r.offset {
 						r.offset++
 					}
@@ -222,10 +923,13 @@ func (r *Reader) readString(echo bool) (string, error) {
 		{ // up arrow (replicate history)
 			codes: []string{"\033[A"},
 			fn: func(s string) ([]byte, error) {
+				if searching {
+					return nil, nil
+				}
 				if echo && pick < len(r.h) {
 					old := r.h[len(r.h)-pick-1]
 					d := []byte(old[:len(old)-1])
-					r.offset = len(d)
+					r.offset = utf8.RuneCount(d)
 					r.unread = d
 					pick++
 				}
@@ -235,7 +939,7 @@ func (r *Reader) readString(echo bool) (string, error) {
 		{ // down arrow (replicate history, or clear line)
 			codes: []string{"\033[B"},
 			fn: func(s string) ([]byte, error) {
-				if !echo {
+				if searching || !echo {
 					return nil, nil
 				}
 				dPick := pick - 2
@@ -243,7 +947,7 @@ func (r *Reader) readString(echo bool) (string, error) {
 					pick--
 					old := r.h[len(r.h)-dPick-1]
 					d := []byte(old[:len(old)-1])
-					r.offset = len(d)
+					r.offset = utf8.RuneCount(d)
 					r.unread = d
 				} else {
 					r.offset = 0
@@ -256,9 +960,12 @@ func (r *Reader) readString(echo bool) (string, error) {
 		{ // right arrow
 			codes: []string{"\033[C"},
 			fn: func(s string) ([]byte, error) {
+				if searching {
+					return nil, nil
+				}
 				r.offset++
-				if r.offset > len(r.unread) {
-					r.offset = len(r.unread)
+				if n := utf8.RuneCount(r.unread); r.offset > n {
+					r.offset = n
 				}
 				return nil, nil
 			},
@@ -266,6 +973,9 @@ func (r *Reader) readString(echo bool) (string, error) {
 		{ // left arrow
 			codes: []string{"\033[D"},
 			fn: func(s string) ([]byte, error) {
+				if searching {
+					return nil, nil
+				}
 				r.offset--
 				if r.offset < 0 {
 					r.offset = 0
@@ -273,47 +983,157 @@ func (r *Reader) readString(echo bool) (string, error) {
 				return nil, nil
 			},
 		},
-		{ // Carriage return.
+		{ // Tab completion.
+			codes: []string{"\t"},
+			fn: func(s string) ([]byte, error) {
+				if searching {
+					return nil, nil
+				}
+				if r.completer == nil {
+					tabs = 0
+					return nil, nil
+				}
+				head, completions, tail := r.completer(string(r.unread), r.offset)
+				switch len(completions) {
+				case 0:
+					tabs = 0
+				case 1:
+					d := []byte(head + completions[0] + tail)
+					r.offset = utf8.RuneCountInString(head) + utf8.RuneCountInString(completions[0])
+					r.unread = d
+					tabs = 0
+				default:
+					prefix := commonPrefix(completions)
+					d := []byte(head + prefix + tail)
+					r.offset = utf8.RuneCountInString(head) + utf8.RuneCountInString(prefix)
+					r.unread = d
+					tabs++
+					if tabs > 1 {
+						r.listCandidates(completions)
+						// The listing leaves the cursor on a
+						// fresh line, so the next redraw
+						// starts from column zero.
+						r.atC = 1
+						wasRow, wasCol = 0, 0
+						wasLines = 0
+						firstDraw = true
+						tabs = 0
+					}
+				}
+				return nil, nil
+			},
+		},
+		{ // Begin bracketed paste.
+			codes: []string{"\033[200~"},
+			fn: func(s string) ([]byte, error) {
+				r.pasting = true
+				return nil, nil
+			},
+		},
+		{ // Carriage return, or accept the current search match.
 			codes: []string{"\r", "\n"},
 			fn: func(s string) ([]byte, error) {
-				r.offset = len(r.unread)
-				newline = r.offset
-				fmt.Println("\r") // even when echo == false.
+				if searching {
+					endSearch(true)
+					return nil, nil
+				}
+				r.offset = utf8.RuneCount(r.unread)
+				newline = len(r.unread)
+				fmt.Fprintln(r.out, "\r") // even when echo == false.
 				return []byte("\n"), nil
 			},
 		},
 	}
 
-	// was holds the last iteration offset position.
-	was := 0
-	// wasLines holds the last iteration number of lines
-	wasLines := 0
 	for {
 		if newline != -1 {
 			line := string(r.unread[:newline+1])
 			if echo {
-				r.h = append(r.h, line)
+				r.addHistory(line)
 			}
 			r.unread = append(r.unread[newline+1:], p[:from]...)
 			r.offset = 0
 			return line, nil
 		}
 
-		n, err := os.Stdin.Read(p[from:])
-		if n == 0 && err != nil {
-			return "", err
+		var n int
+		var err error
+		if len(r.pastePending) > 0 {
+			// Resume scanning a paste whose tail was carried over
+			// from a prior line return, rather than blocking on
+			// r.in: it may still hold more embedded lines or the
+			// end marker, and must go through the same paste/end-
+			// marker logic below, not be read as fresh input.
+			n = copy(p[from:], r.pastePending)
+			r.pastePending = r.pastePending[n:]
+		} else {
+			n, err = readWithCancel(r.in, p[from:], cancel)
+			if n == 0 && err != nil {
+				return "", err
+			}
 		}
 		from += n
 
 		for from > 0 {
+			if r.pasting {
+				// Inside a bracketed paste, bytes are taken
+				// literally: no specials (Ctrl-C, Tab, history
+				// recall, ...) fire until the closing marker
+				// arrives.
+				const endMarker = "\033[201~"
+				if bytes.HasPrefix(p[:from], []byte(endMarker)) {
+					r.pasting = false
+					c := len(endMarker)
+					copy(p[:], p[c:])
+					from -= c
+					continue
+				}
+				if from < len(endMarker) && bytes.HasPrefix([]byte(endMarker), p[:from]) {
+					break // could still be the start of the end marker.
+				}
+				size := 1
+				if p[0] >= utf8.RuneSelf {
+					if !utf8.FullRune(p[:from]) && from < utf8.UTFMax {
+						break
+					}
+					_, size = utf8.DecodeRune(p[:from])
+				}
+				if p[0] == '\n' && !r.multilinePaste {
+					// End the current line at the paste
+					// boundary, as if Enter had been pressed. The
+					// rest of p may still hold more embedded lines
+					// or the end marker, so it must not be spliced
+					// into r.unread as already-typed text; stash it
+					// in r.pastePending to re-enter paste/end-marker
+					// scanning on it next (possibly after this line
+					// is returned to the caller).
+					r.unread = append(r.unread, '\n')
+					newline = len(r.unread) - 1
+					r.offset = utf8.RuneCount(r.unread)
+					fmt.Fprintln(r.out, "\r")
+					r.pastePending = append([]byte(nil), p[1:from]...)
+					from = 0
+					break
+				}
+				rs := bytes.Runes(r.unread)
+				d := append([]rune{}, rs[:r.offset]...)
+				d = append(d, bytes.Runes(p[:size])...)
+				d = append(d, rs[r.offset:]...)
+				r.unread = []byte(string(d))
+				r.offset++
+				copy(p[:], p[size:])
+				from -= size
+				continue
+			}
 			if _, ok := match(p, "\003"); ok {
-				fmt.Print("^C")
+				fmt.Fprint(r.out, "^C")
 				return "", ErrTerminated
 			}
 			b := []byte{p[0]}
 			partial := false
 			found := false
 			keep := false
+			matched := ""
 			for _, sp := range specials {
 				if found {
 					break
@@ -340,15 +1160,41 @@ func (r *Reader) readString(echo bool) (string, error) {
 						from -= c
 					}
 					found = true
+					matched = m
 					break
 				}
 			}
 
+			if found && matched != "\t" {
+				tabs = 0
+			}
+			if found && matched != "\033d" && matched != "\027" && matched != "\025" && matched != "\013" {
+				lastWasKill = false
+			}
+			if found && matched != "\031" && matched != "\033y" {
+				justYanked = false
+			}
+
 			if found && !keep {
 				continue
 			} else if partial {
 				// still a chance we'll find a match.
 				break
+			} else if found {
+				// A special matched and asked for its
+				// replacement text (currently only Enter,
+				// substituting "\n") to be inserted verbatim
+				// at the cursor.
+				rs := bytes.Runes(r.unread)
+				d := append([]rune{}, rs[:r.offset]...)
+				d = append(d, bytes.Runes(b)...)
+				d = append(d, rs[r.offset:]...)
+				r.unread = []byte(string(d))
+				r.offset++
+				c := len(matched)
+				copy(p[:], p[c:])
+				from -= c
+				continue
 			}
 
 			// Check for the initial cursor location. This
@@ -375,12 +1221,43 @@ func (r *Reader) readString(echo bool) (string, error) {
 				}
 			}
 
-			// Consume exactly one character of input.
-			b = append(b, r.unread[r.offset:]...)
-			r.unread = append(r.unread[:r.offset], b...)
+			// Consume exactly one full UTF-8 rune of input,
+			// waiting for more bytes if what's buffered so far is
+			// a truncated multi-byte sequence.
+			size := 1
+			if p[0] >= utf8.RuneSelf {
+				if !utf8.FullRune(p[:from]) && from < utf8.UTFMax {
+					break
+				}
+				_, size = utf8.DecodeRune(p[:from])
+			}
+
+			tabs = 0
+			lastWasKill = false
+			justYanked = false
+			if searching {
+				// Ctrl-G, or a bare ESC once it's no longer a
+				// possible prefix of a recognized escape
+				// sequence above, cancels the search.
+				if p[0] == '\007' || p[0] == '\033' {
+					endSearch(false)
+				} else {
+					pattern = append(pattern, p[:size]...)
+					searchNewest()
+					renderSearch()
+				}
+				copy(p[:], p[size:])
+				from -= size
+				continue
+			}
+			rs := bytes.Runes(r.unread)
+			d := append([]rune{}, rs[:r.offset]...)
+			d = append(d, bytes.Runes(p[:size])...)
+			d = append(d, rs[r.offset:]...)
+			r.unread = []byte(string(d))
 			r.offset++
-			copy(p[:], p[1:])
-			from--
+			copy(p[:], p[size:])
+			from -= size
 		}
 
 		if newline == -1 && echo {
@@ -389,41 +1266,63 @@ func (r *Reader) readString(echo bool) (string, error) {
 			// zero base the coordinate of the prompt.
 			cOffset := r.atC - 1
 
-			// return to line start
-			cD := (was - 1 + cOffset) % w
-			cAt := cD + 1 - cOffset
-			cUp := (was - 1 + cOffset) / w
-
-			r.up(cUp)
-			r.left(cAt)
+			// Return the cursor to the start of the line (row 0,
+			// column cOffset), from wherever the previous redraw
+			// left it.
+			if !firstDraw {
+				r.up(wasRow)
+				r.left(wasCol - cOffset)
+			}
 
 			rs := bytes.Runes(r.unread)
-			n := len(rs) // runes to print (for now assume runes are 1 column wide)
 
-			// display full line content
-			cAt = ((n - 1 + cOffset) % w) - ((r.offset - 1 + cOffset) % w)
-			cUp = (n-1+cOffset)/w - (r.offset-1+cOffset)/w
-			was = r.offset
-			lines := 0
+			// Walk the line, printing each rune and wrapping
+			// (before, not after, a rune that would straddle the
+			// boundary) according to its display column width, so
+			// double-width and zero-width runes are accounted for.
+			row, col := 0, cOffset
+			curRow, curCol := 0, cOffset
 			for i, u := range rs {
-				ch := string(u)
-				if at := (i + cOffset) % w; at == 0 {
-					fmt.Print("\\\r\n")
-					lines++
+				if u == '\n' {
+					// An embedded newline, from a multi-line
+					// paste, forces a line break regardless of
+					// column.
+					if i == r.offset {
+						curRow, curCol = row, col
+					}
+					fmt.Fprint(r.out, "\r\n")
+					row++
+					col = 0
+					continue
+				}
+				cw := runeWidth(u)
+				if col+cw > w {
+					fmt.Fprint(r.out, "\\\r\n")
+					row++
+					col = 0
+				}
+				if i == r.offset {
+					curRow, curCol = row, col
 				}
-				fmt.Print(ch)
+				fmt.Fprint(r.out, string(u))
+				col += cw
+			}
+			if r.offset >= len(rs) {
+				curRow, curCol = row, col
 			}
 			r.clearEOL()
-			if wasLines > lines {
-				for i := lines; i < wasLines; i++ {
+			if wasLines > row {
+				for i := row; i < wasLines; i++ {
 					r.down(1)
 					r.clearLine()
 				}
-				r.up(cUp + wasLines - lines)
+				r.up(wasLines - row)
 			}
-			r.up(cUp)
-			r.left(cAt)
-			wasLines = lines
+			r.up(row - curRow)
+			r.left(col - curCol)
+			wasLines = row
+			wasRow, wasCol = curRow, curCol
+			firstDraw = false
 		}
 	}
 }
@@ -442,3 +1341,71 @@ func (r *Reader) ReadString() (string, error) {
 func (r *Reader) ReadPassword() (string, error) {
 	return r.readString(false)
 }
+
+// deadlineReader is implemented by inputs, such as *os.File and
+// net.Conn, that can have a pending Read unblocked from another
+// goroutine. ReadStringContext uses it, where available, as a prompt
+// for the abandoned read to return quickly; readStringCancel's cancel
+// channel, not this, is what guarantees r.mu is released on time.
+type deadlineReader interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// ReadStringContext is like ReadString, but returns ctx.Err() as soon
+// as ctx is canceled, instead of waiting for a full line. Cancellation
+// always releases r.mu immediately, so Close and a subsequent
+// ReadString/ReadStringContext call never block behind it, regardless
+// of what the Reader's input is. The read itself is abandoned rather
+// than joined: if the input also implements deadlineReader, its
+// deadline is set to encourage a prompt return; otherwise it is left
+// to complete in the background, its result discarded, once more
+// input arrives or the connection is closed.
+func (r *Reader) ReadStringContext(ctx context.Context) (string, error) {
+	if r == nil {
+		return "", ErrNoReader
+	}
+	cancel := make(chan struct{})
+	type result struct {
+		line string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		line, err := r.readStringCancel(true, cancel)
+		done <- result{line, err}
+	}()
+	select {
+	case res := <-done:
+		return res.line, res.err
+	case <-ctx.Done():
+		close(cancel)
+		if dr, ok := r.in.(deadlineReader); ok {
+			dr.SetReadDeadline(time.Now())
+		}
+		return "", ctx.Err()
+	}
+}
+
+// Close releases the resources a Reader's input and output hold, so a
+// long-lived program can guarantee cleanup on shutdown: in and out are
+// closed if they implement io.Closer. The first error encountered, if
+// any, is returned.
+func (r *Reader) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var first error
+	if c, ok := r.in.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			first = err
+		}
+	}
+	if c, ok := r.out.(io.Closer); ok && any(r.out) != any(r.in) {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
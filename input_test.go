@@ -0,0 +1,421 @@
+package lined
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stepReader hands back its chunks one Read call at a time, so each
+// chunk is processed (and redrawn) as its own readStringCancel
+// iteration, mimicking a real tty delivering one keystroke per read.
+type stepReader struct {
+	chunks [][]byte
+	i      int
+}
+
+func (s *stepReader) Read(p []byte) (int, error) {
+	if s.i >= len(s.chunks) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.chunks[s.i])
+	s.i++
+	return n, nil
+}
+
+// fixedSizer reports a constant terminal size.
+type fixedSizer struct {
+	cols, rows int
+}
+
+func (f fixedSizer) GetSize() (cols, rows int, err error) {
+	return f.cols, f.rows, nil
+}
+
+func TestRuneWidth(t *testing.T) {
+	const (
+		combiningAcuteAccent = '\u0301' // combining acute accent
+		combiningTilde       = '\u0303' // combining tilde
+		cjkIdeograph         = '\u4e2d' // CJK ideograph
+		hiragana             = '\u3042' // hiragana letter
+		fullwidthLatinA      = '\uff21' // fullwidth latin A
+	)
+	cases := []struct {
+		name string
+		u    rune
+		want int
+	}{
+		{"ascii letter", 'a', 1},
+		{"ascii digit", '0', 1},
+		{"combining acute accent", combiningAcuteAccent, 0},
+		{"combining tilde", combiningTilde, 0},
+		{"cjk ideograph", cjkIdeograph, 2},
+		{"hiragana", hiragana, 2},
+		{"fullwidth latin A", fullwidthLatinA, 2},
+	}
+	for _, c := range cases {
+		if got := runeWidth(c.u); got != c.want {
+			t.Errorf("%s: runeWidth(%q) = %d, want %d", c.name, c.u, got, c.want)
+		}
+	}
+}
+
+func TestDisplayWidth(t *testing.T) {
+	// eAcuteDecomposed is "e" followed by U+0301 COMBINING ACUTE
+	// ACCENT: two runes, one of them zero-width, so the combined
+	// display width is still 1.
+	eAcuteDecomposed := "e" + "\u0301"
+	cjkWord := "\u4e2d\u6587"          // CJK "中文"
+	mixedAsciiCJK := "go \u8a00\u8a9e" // "go 言語"
+
+	cases := []struct {
+		name string
+		s    string
+		want int
+	}{
+		{"empty", "", 0},
+		{"plain ascii", "hello", 5},
+		{"decomposed e with combining acute", eAcuteDecomposed, 1},
+		{"cjk word", cjkWord, 4},
+		{"mixed ascii and cjk", mixedAsciiCJK, 7},
+	}
+	for _, c := range cases {
+		if got := displayWidth(c.s); got != c.want {
+			t.Errorf("%s: displayWidth(%q) = %d, want %d", c.name, c.s, got, c.want)
+		}
+	}
+}
+
+func TestWordBackForwardRuneBoundaries(t *testing.T) {
+	// "日本語 hello" has three wide CJK runes followed by a
+	// space and an ASCII word; word navigation must count runes, not
+	// bytes, or it lands mid-character.
+	s := []byte("日本語 hello")
+	n := len([]rune("日本語 hello"))
+
+	if got := wordForward(s, 0); got != 3 {
+		t.Errorf("wordForward(s, 0) = %d, want 3 (end of the CJK run)", got)
+	}
+	if got := wordBack(s, n); got != 4 {
+		t.Errorf("wordBack(s, %d) = %d, want 4 (start of \"hello\")", n, got)
+	}
+}
+
+// TestHistoryLoadSaveDedup checks that LoadHistory merges in
+// newline-terminated entries (skipping blanks), that consecutive
+// duplicates are suppressed the same way addHistory suppresses them
+// during interactive entry, and that SaveHistory round-trips the
+// result back out verbatim.
+func TestHistoryLoadSaveDedup(t *testing.T) {
+	r := NewReaderIO(nil, nil, nil)
+
+	in := strings.NewReader("ls -l\n\nls -l\ncd /tmp\n")
+	n, err := r.LoadHistory(in)
+	if err != nil {
+		t.Fatalf("LoadHistory() error: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("LoadHistory() added %d entries, want 2 (consecutive duplicate and blank line dropped)", n)
+	}
+
+	r.AppendHistory("cd /tmp")
+	if n := len(r.h); n != 2 {
+		t.Fatalf("len(r.h) = %d after a duplicate AppendHistory, want 2", n)
+	}
+	r.AppendHistory("pwd")
+
+	var out bytes.Buffer
+	if err := r.SaveHistory(&out); err != nil {
+		t.Fatalf("SaveHistory() error: %v", err)
+	}
+	if want := "ls -l\ncd /tmp\npwd\n"; out.String() != want {
+		t.Errorf("SaveHistory() = %q, want %q", out.String(), want)
+	}
+}
+
+// TestHistorySetMaxHistory checks that SetMaxHistory trims existing
+// history immediately, and that it continues to bound history as new
+// entries are recorded.
+func TestHistorySetMaxHistory(t *testing.T) {
+	r := NewReaderIO(nil, nil, nil)
+	for _, line := range []string{"a", "b", "c"} {
+		r.AppendHistory(line)
+	}
+	r.SetMaxHistory(2)
+	if got := []string{r.h[0], r.h[1]}; got[0] != "b\n" || got[1] != "c\n" {
+		t.Fatalf("history after SetMaxHistory(2) = %q, want [b c]", got)
+	}
+	r.AppendHistory("d")
+	if n := len(r.h); n != 2 {
+		t.Fatalf("len(r.h) = %d after exceeding SetMaxHistory, want 2", n)
+	}
+	if r.h[0] != "c\n" || r.h[1] != "d\n" {
+		t.Fatalf("history = %q, want [c d]", r.h)
+	}
+}
+
+// blockingReader never returns from Read, and supports neither
+// SetReadDeadline nor io.Closer, so ReadStringContext's only way to
+// return promptly is the internal cancel channel readWithCancel
+// selects on.
+type blockingReader struct{}
+
+func (blockingReader) Read(p []byte) (int, error) {
+	select {}
+}
+
+// TestReadStringContextCancelReleasesLock checks that ReadStringContext
+// returns promptly when ctx is canceled even though the underlying
+// Read call is permanently blocked, and that r.mu is consequently
+// released so a subsequent Close does not deadlock waiting for it.
+func TestReadStringContextCancelReleasesLock(t *testing.T) {
+	r := NewReaderIO(blockingReader{}, new(bytes.Buffer), fixedSizer{cols: 80, rows: 24})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	line, err := r.ReadStringContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("ReadStringContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if line != "" {
+		t.Fatalf("ReadStringContext() = %q, want \"\"", line)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- r.Close() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Close() error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close() deadlocked waiting for r.mu after ReadStringContext cancellation")
+	}
+}
+
+// TestReadStringCompleterSingleMatch drives ReadString through a Tab
+// press with a Completer that has exactly one match, checking that
+// the match is spliced in at the cursor via the returned head/tail
+// and the line can be submitted immediately afterward.
+func TestReadStringCompleterSingleMatch(t *testing.T) {
+	r := NewReaderIO(nil, nil, nil)
+	r.SetCompleter(func(line string, pos int) (string, []string, string) {
+		if line == "fo" && pos == 2 {
+			return "", []string{"food"}, ""
+		}
+		return "", nil, ""
+	})
+
+	chunks := [][]byte{[]byte("f"), []byte("o"), []byte("\t"), []byte("\n")}
+	in := &stepReader{chunks: chunks}
+	r.in = in
+	var out bytes.Buffer
+	r.out = &out
+	r.sizer = fixedSizer{cols: 80, rows: 24}
+
+	line, err := r.ReadString()
+	if err != nil {
+		t.Fatalf("ReadString() error: %v", err)
+	}
+	if want := "food\n"; line != want {
+		t.Fatalf("ReadString() = %q, want %q", line, want)
+	}
+}
+
+// TestReadStringHistorySearchAccept drives ReadString through a
+// reverse incremental search (Ctrl-R) that narrows as the pattern
+// grows, accepts the match into the edit buffer, and then submits it
+// with a second Enter, exercising the whole Ctrl-R/pattern/accept
+// state machine end-to-end.
+func TestReadStringHistorySearchAccept(t *testing.T) {
+	r := NewReaderIO(nil, nil, nil)
+	if _, err := r.LoadHistory(strings.NewReader("cd /tmp\nls -l\n")); err != nil {
+		t.Fatalf("LoadHistory() error: %v", err)
+	}
+
+	var chunks [][]byte
+	chunks = append(chunks, []byte("\022")) // Ctrl-R: start search, matches newest ("ls -l")
+	chunks = append(chunks, []byte("c"))    // narrows the match to "cd /tmp"
+	chunks = append(chunks, []byte("\r"))   // accept the match into the buffer (search ends, line not yet submitted)
+	chunks = append(chunks, []byte("\r"))   // submit the accepted buffer
+
+	in := &stepReader{chunks: chunks}
+	r.in = in
+	var out bytes.Buffer
+	r.out = &out
+	r.sizer = fixedSizer{cols: 80, rows: 24}
+
+	line, err := r.ReadString()
+	if err != nil {
+		t.Fatalf("ReadString() error: %v", err)
+	}
+	if want := "cd /tmp\n"; line != want {
+		t.Fatalf("ReadString() = %q, want %q", line, want)
+	}
+}
+
+// TestReadStringHistorySearchCancel checks that Ctrl-G cancels an
+// in-progress search and restores the buffer exactly as it was
+// before Ctrl-R was pressed, rather than leaving the search prompt or
+// a partial match behind.
+func TestReadStringHistorySearchCancel(t *testing.T) {
+	r := NewReaderIO(nil, nil, nil)
+	if _, err := r.LoadHistory(strings.NewReader("cd /tmp\n")); err != nil {
+		t.Fatalf("LoadHistory() error: %v", err)
+	}
+
+	var chunks [][]byte
+	for _, c := range "ab" {
+		chunks = append(chunks, []byte(string(c)))
+	}
+	chunks = append(chunks, []byte("\022")) // Ctrl-R: start search over "ab"
+	chunks = append(chunks, []byte("z"))    // no history entry contains "z"
+	chunks = append(chunks, []byte("\007")) // Ctrl-G: cancel, restoring "ab"
+	chunks = append(chunks, []byte("\r"))
+
+	in := &stepReader{chunks: chunks}
+	r.in = in
+	var out bytes.Buffer
+	r.out = &out
+	r.sizer = fixedSizer{cols: 80, rows: 24}
+
+	line, err := r.ReadString()
+	if err != nil {
+		t.Fatalf("ReadString() error: %v", err)
+	}
+	if want := "ab\n"; line != want {
+		t.Fatalf("ReadString() = %q, want %q (search cancel should restore the pre-search buffer)", line, want)
+	}
+}
+
+// TestAddKillMergeAndBound checks that addKill folds consecutive
+// kills into the most recent entry (forward and backward, matching
+// Ctrl-K/Alt-D vs Ctrl-W/Ctrl-U), starts a new entry otherwise, and
+// bounds the ring to maxKillRing.
+func TestAddKillMergeAndBound(t *testing.T) {
+	r := NewReaderIO(nil, nil, nil)
+
+	r.addKill("foo", false, true)
+	r.addKill("bar", true, true) // consecutive kill, forward: append
+	if want := []string{"foobar"}; len(r.kills) != 1 || r.kills[0] != want[0] {
+		t.Fatalf("r.kills = %q, want %q", r.kills, want)
+	}
+
+	r.addKill("pre", true, false) // consecutive kill, backward: prepend
+	if want := "prefoobar"; r.kills[0] != want {
+		t.Fatalf("r.kills[0] = %q, want %q", r.kills[0], want)
+	}
+
+	r.addKill("next", false, true) // not consecutive: new entry
+	if len(r.kills) != 2 || r.kills[1] != "next" {
+		t.Fatalf("r.kills = %q, want a second entry %q", r.kills, "next")
+	}
+
+	for i := 0; i < maxKillRing+5; i++ {
+		r.addKill(string(rune('a'+i%26)), false, true)
+	}
+	if len(r.kills) != maxKillRing {
+		t.Fatalf("len(r.kills) = %d after overflow, want %d (bounded)", len(r.kills), maxKillRing)
+	}
+}
+
+// TestReadStringKillAndYankCycle drives ReadString through a
+// Ctrl-W/Ctrl-W/Ctrl-Y/Alt-Y sequence, exercising the kill ring and
+// the yank/yank-cycle logic end-to-end: two non-consecutive kills,
+// then a yank of the most recent, then Alt-Y cycling it back to the
+// one before.
+func TestReadStringKillAndYankCycle(t *testing.T) {
+	var chunks [][]byte
+	for _, r := range "hello world" {
+		chunks = append(chunks, []byte(string(r)))
+	}
+	chunks = append(chunks, []byte("\x17")) // Ctrl-W: kill "world"
+	for _, r := range "foo" {
+		chunks = append(chunks, []byte(string(r)))
+	}
+	chunks = append(chunks, []byte("\x17"))  // Ctrl-W: kill "foo" (new entry, not merged)
+	chunks = append(chunks, []byte("\x19"))  // Ctrl-Y: yank "foo" back
+	chunks = append(chunks, []byte("\033y")) // Alt-Y: cycle the yank to "world"
+	chunks = append(chunks, []byte("\n"))
+
+	in := &stepReader{chunks: chunks}
+	var out bytes.Buffer
+	r := NewReaderIO(in, &out, fixedSizer{cols: 80, rows: 24})
+
+	line, err := r.ReadString()
+	if err != nil {
+		t.Fatalf("ReadString() error: %v", err)
+	}
+	if want := "hello world\n"; line != want {
+		t.Fatalf("ReadString() = %q, want %q", line, want)
+	}
+	if want := []string{"world", "foo"}; len(r.kills) != 2 || r.kills[0] != want[0] || r.kills[1] != want[1] {
+		t.Fatalf("r.kills = %q, want %q", r.kills, want)
+	}
+}
+
+// TestReadStringRedrawWrapsWideCJKRunes drives ReadString one
+// keystroke at a time through three double-width CJK runes narrow
+// enough to force a mid-line wrap, and checks the exact redraw bytes
+// emitted: the column math (r.col-1 wrap width) must account for each
+// rune's display width, not its rune count, and the "\\\r\n" wrap
+// marker must land before the rune that would overflow the row.
+func TestReadStringRedrawWrapsWideCJKRunes(t *testing.T) {
+	const (
+		zhong = "中" // 中, display width 2
+		wen   = "文" // 文, display width 2
+		zi    = "字" // 字, display width 2
+	)
+	in := &stepReader{chunks: [][]byte{
+		[]byte(zhong), []byte(wen), []byte(zi), []byte("\n"),
+	}}
+	var out bytes.Buffer
+	r := NewReaderIO(in, &out, fixedSizer{cols: 6, rows: 24})
+
+	line, err := r.ReadString()
+	if err != nil {
+		t.Fatalf("ReadString() error: %v", err)
+	}
+	if want := zhong + wen + zi + "\n"; line != want {
+		t.Fatalf("ReadString() = %q, want %q", line, want)
+	}
+
+	want := zhong + "\033[0K" +
+		"\033[2D" + zhong + wen + "\033[0K" +
+		"\033[4D" + zhong + wen + "\\\r\n" + zi + "\033[0K" +
+		"\r\n"
+	if got := out.String(); got != want {
+		t.Errorf("redraw output = %q, want %q", got, want)
+	}
+}
+
+// TestReadStringRedrawCombiningAccent checks that a zero-width
+// combining accent is printed but contributes nothing to the column
+// bookkeeping that drives cursor-return movement between redraws.
+func TestReadStringRedrawCombiningAccent(t *testing.T) {
+	const acute = "́" // combining acute accent, display width 0
+	in := &stepReader{chunks: [][]byte{
+		[]byte("e"), []byte(acute), []byte("\n"),
+	}}
+	var out bytes.Buffer
+	r := NewReaderIO(in, &out, fixedSizer{cols: 40, rows: 24})
+
+	line, err := r.ReadString()
+	if err != nil {
+		t.Fatalf("ReadString() error: %v", err)
+	}
+	if want := "e" + acute + "\n"; line != want {
+		t.Fatalf("ReadString() = %q, want %q", line, want)
+	}
+
+	want := "e" + "\033[0K" +
+		"\033[1D" + "e" + acute + "\033[0K" +
+		"\r\n"
+	if got := out.String(); got != want {
+		t.Errorf("redraw output = %q, want %q", got, want)
+	}
+}